@@ -2,7 +2,10 @@ package manatcp
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -35,49 +38,165 @@ type readWrap struct {
 	die  bool
 }
 
+// Pinger is an optional interface a Client or ServerClient may additionally
+// implement to support manatcp's idle-connection heartbeat: Conn.StartPing
+// on the client side, ListenOpts.Ping on the server side.
+type Pinger interface {
+	// Ping returns the item to write to the other side as a heartbeat.
+	Ping() interface{}
+}
+
 // Conn handles the command/response sequence as well as putting push messages
-// from the server into the PushCh. It is meant to be interacted with in a
-// single-threaded manner (with the exception of PushCh, which can be read from
-// in a separate go-routine).
+// from the server into the PushCh.
+//
+// Cmd and CmdPipelined may both be called concurrently from any number of
+// go-routines: writes are serialized internally, and each command's response
+// is queued up and matched back to its caller in the order the commands were
+// sent. CmdPipelined additionally honors MaxInFlight for backpressure. Aside
+// from this, Conn is meant to be interacted with in a single-threaded manner
+// (with the exception of PushCh, which can be read from in a separate
+// go-routine).
 type Conn struct {
 	conn   net.Conn
 	buf    *bufio.ReadWriter
 	client Client
-	readCh chan *readWrap
+
+	// writeMu serializes Write+Flush pairs so concurrent Cmd/CmdPipelined
+	// calls don't interleave their writes on the wire.
+	writeMu sync.Mutex
+
+	// pending holds, in send order, the channels waiting on a response to a
+	// previously sent (non-background) command. spin pops off the front of
+	// this on every non-push read.
+	pendingMu sync.Mutex
+	pending   []chan *readWrap
+
+	semOnce sync.Once
+	sem     chan struct{}
+
+	// Maximum number of commands which may be written to the connection but
+	// not yet have a response read back for them, when using CmdPipelined.
+	// Zero (the default) means no limit. This should be set, if at all,
+	// before the first call to CmdPipelined.
+	MaxInFlight int
 
 	// Channel onto-which all push messages are put. This must be read from at
 	// all times or execution inside Conn will be blocked. This channel is
 	// closed when either the client or server terminate the connection.
 	PushCh chan interface{}
+
+	// done is closed by spin once the connection has died, so go-routines
+	// like pingLoop can stop without stealing from PushCh.
+	done chan struct{}
+
+	activityMu   sync.Mutex
+	lastActivity time.Time
 }
 
 // Connects to a server over tcp and initializes a Conn if successful.
 func Dial(c Client, address string) (*Conn, error) {
-	tconn, err := net.Dial("tcp", address)
+	return DialContext(context.Background(), c, address)
+}
+
+// DialContext is like Dial, but the TCP handshake itself can be cancelled by
+// cancelling ctx.
+func DialContext(ctx context.Context, c Client, address string) (*Conn, error) {
+	var d net.Dialer
+	tconn, err := d.DialContext(ctx, "tcp", address)
 	if err != nil {
 		return nil, err
 	}
-	rbuf := bufio.NewReader(tconn)
-	wbuf := bufio.NewWriter(tconn)
-	conn := Conn{
-		conn:   tconn,
-		buf:    bufio.NewReadWriter(rbuf, wbuf),
-		client: c,
-		readCh: make(chan *readWrap),
-		PushCh: make(chan interface{}),
+	return DialConn(c, tconn)
+}
+
+// DialConn initializes a Conn around an already-established net.Conn, rather
+// than dialing one itself. This is the entry point for anything Dial doesn't
+// cover directly: TLS (wrap the result of tls.Dial), Unix domain sockets, a
+// pre-authenticated connection handed off from elsewhere, or an in-memory
+// net.Pipe for tests. See also DialWithOpts, which covers the common
+// TLS/custom-dialer cases without requiring the caller to dial manually.
+func DialConn(c Client, conn net.Conn) (*Conn, error) {
+	rbuf := bufio.NewReader(conn)
+	wbuf := bufio.NewWriter(conn)
+	cn := Conn{
+		conn:         conn,
+		buf:          bufio.NewReadWriter(rbuf, wbuf),
+		client:       c,
+		PushCh:       make(chan interface{}),
+		done:         make(chan struct{}),
+		lastActivity: time.Now(),
 	}
-	go conn.spin()
-	return &conn, nil
+	go cn.spin()
+	return &cn, nil
+}
+
+// Dialer establishes the underlying connection for DialWithOpts. *net.Dialer
+// satisfies this already; a custom implementation can be given to dial
+// through a proxy, SOCKS, or other wrapped transport.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DialOpts holds optional configuration for DialWithOpts.
+type DialOpts struct {
+	// TLSConfig, if set, causes the dialed connection to be wrapped in a TLS
+	// client handshake using this config before the Conn is created.
+	TLSConfig *tls.Config
+
+	// HandshakeTimeout bounds how long the TLS handshake triggered by
+	// TLSConfig is allowed to take before DialWithOpts gives up and returns
+	// an error, rather than blocking forever on a peer that stalls it. Zero
+	// means no timeout. Ignored if TLSConfig is nil.
+	HandshakeTimeout time.Duration
+
+	// Dialer is used to establish the underlying connection. If nil, a
+	// zero-value *net.Dialer is used.
+	Dialer Dialer
+
+	// KeepAlive, if non-zero, is used as the keep-alive period on the
+	// default *net.Dialer. It's ignored if Dialer is set; configure
+	// keep-alive on the custom Dialer directly in that case.
+	KeepAlive time.Duration
+}
+
+// DialWithOpts is like Dial, but dials over the given network (e.g. "tcp",
+// "unix") using the given DialOpts to control TLS, the Dialer used, and
+// keep-alive.
+func DialWithOpts(c Client, network, address string, opts DialOpts) (*Conn, error) {
+	dialer := opts.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{KeepAlive: opts.KeepAlive}
+	}
+	conn, err := dialer.DialContext(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	if opts.TLSConfig != nil {
+		tconn := tls.Client(conn, opts.TLSConfig)
+		if opts.HandshakeTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(opts.HandshakeTimeout))
+		}
+		// Unlike tls.Dial, tls.Client doesn't perform the handshake itself;
+		// without this it happens lazily on the first Read/Write, so a
+		// handshake failure would otherwise surface as an unexplained hang
+		// or error on the first Cmd instead of here.
+		if err := tconn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if opts.HandshakeTimeout > 0 {
+			conn.SetDeadline(time.Time{})
+		}
+		conn = tconn
+	}
+	return DialConn(c, conn)
 }
 
 func (conn *Conn) spin() {
 	for {
 		item, err, die := conn.client.Read(conn.buf.Reader)
 		if err != nil || !conn.client.IsPush(item) {
-			select {
-			case conn.readCh <- &readWrap{item, err, die}:
-			case <-time.After(2 * time.Second):
-			}
+			conn.respond(&readWrap{item, err, die})
 			if die {
 				break
 			}
@@ -85,26 +204,122 @@ func (conn *Conn) spin() {
 			conn.PushCh <- item
 		}
 	}
+	conn.drain()
 	conn.conn.Close()
 	close(conn.PushCh)
+	close(conn.done)
+}
+
+// touch records that the connection was just used, for idle detection by
+// pingLoop.
+func (conn *Conn) touch() {
+	conn.activityMu.Lock()
+	conn.lastActivity = time.Now()
+	conn.activityMu.Unlock()
+}
+
+// idleSince returns how long it's been since touch was last called.
+func (conn *Conn) idleSince() time.Duration {
+	conn.activityMu.Lock()
+	last := conn.lastActivity
+	conn.activityMu.Unlock()
+	return time.Since(last)
+}
+
+// respond delivers rw to the oldest still-pending Cmd/CmdPipelined call, if
+// there is one. Responses which don't correspond to any pending call (which
+// shouldn't normally happen) are dropped.
+func (conn *Conn) respond(rw *readWrap) {
+	conn.pendingMu.Lock()
+	var ch chan *readWrap
+	if len(conn.pending) > 0 {
+		ch = conn.pending[0]
+		conn.pending = conn.pending[1:]
+	}
+	conn.pendingMu.Unlock()
+	if ch != nil {
+		ch <- rw
+	}
+}
+
+// drain is called once spin has stopped reading from the connection, and
+// unblocks every call still waiting on a response with a die error, so none
+// of them hang forever.
+func (conn *Conn) drain() {
+	conn.pendingMu.Lock()
+	pending := conn.pending
+	conn.pending = nil
+	conn.pendingMu.Unlock()
+	for _, ch := range pending {
+		ch <- &readWrap{nil, nil, true}
+	}
+}
+
+// enqueue registers a new ticket on the end of the pending queue, to be
+// popped off by respond once its response comes back.
+func (conn *Conn) enqueue() chan *readWrap {
+	ch := make(chan *readWrap, 1)
+	conn.pendingMu.Lock()
+	conn.pending = append(conn.pending, ch)
+	conn.pendingMu.Unlock()
+	return ch
+}
+
+// cancel removes a ticket previously returned by enqueue from the pending
+// queue, for use when the write it was waiting on never made it onto the
+// wire.
+func (conn *Conn) cancel(ch chan *readWrap) {
+	if ch == nil {
+		return
+	}
+	conn.pendingMu.Lock()
+	for i, c := range conn.pending {
+		if c == ch {
+			conn.pending = append(conn.pending[:i], conn.pending[i+1:]...)
+			break
+		}
+	}
+	conn.pendingMu.Unlock()
 }
 
 func (conn *Conn) cmd(cmd interface{}, bg bool) (interface{}, error, bool) {
+	// ch must be enqueued inside the writeMu critical section: the pending
+	// queue's order is what ties a response back to its caller, so that
+	// order has to be established atomically with the write actually
+	// landing on the wire, not some time before it.
+	//
+	// bg calls don't enqueue a ticket at all: per doc.go and
+	// ServerClient.HandleCmd's sendback return, whether the server responds
+	// to a given command is a property of the protocol that the client has
+	// no way to predict ahead of time, so there's no reliable way to pop a
+	// ticket for a response that may never come. That does mean a bg
+	// command the server unexpectedly *does* respond to will have its
+	// response misdelivered by respond to whatever unrelated call happens
+	// to be waiting on the oldest ticket next; see CmdBg's doc comment.
+	conn.writeMu.Lock()
+	var ch chan *readWrap
+	if !bg {
+		ch = conn.enqueue()
+	}
 	err, die := conn.client.Write(conn.buf.Writer, cmd)
+	if err == nil {
+		if err = conn.buf.Writer.Flush(); err != nil {
+			die = true
+		}
+	}
+	conn.writeMu.Unlock()
+
 	if err != nil {
+		conn.cancel(ch)
 		return nil, err, die
-	} else if bg {
-		return nil, nil, false
 	}
-
-	if err = conn.buf.Writer.Flush(); err != nil {
-		return nil, err, true
+	conn.touch()
+	if bg {
+		return nil, nil, false
 	}
 
-	select {
-	case rw := <-conn.readCh:
-		return rw.item, rw.err, rw.die
-	}
+	rw := <-ch
+	return rw.item, rw.err, rw.die
 }
 
 // Sends a cmd to the connection (to be processed by Write) and waits for a
@@ -115,8 +330,113 @@ func (conn *Conn) Cmd(cmd interface{}) (interface{}, error, bool) {
 	return conn.cmd(cmd, false)
 }
 
-// Similar to Cmd, but doesn't wait for a response. This will still block to
-// find out if there are any errors when reading/writing/marshalling.
+// CmdContext behaves like Cmd, but accepts a context.Context which can be
+// used to time out or cancel the call. If ctx has a deadline, it's set as
+// both the write and read deadline on the underlying net.Conn for the
+// duration of this call.
+//
+// That deadline is connection-global state, not scoped to this call: if any
+// other Cmd/CmdPipelined/CmdContext/CmdBg call may be outstanding on the
+// same Conn at the same time, its write or read can be failed early by this
+// call's deadline, or have a deadline it's relying on cleared early once
+// this call returns. CmdContext must therefore only be used when there is
+// at most one command outstanding on the Conn at a time (i.e. not alongside
+// CmdPipelined, not from multiple go-routines calling Cmd/CmdContext
+// concurrently, and not on a Conn with StartPing running, since its
+// background pings count as outstanding commands too).
+//
+// If ctx is done before the response arrives, CmdContext returns ctx.Err()
+// immediately and closes the Conn: whatever bytes the server eventually
+// sends for the cancelled command are still coming down the wire, and
+// without a caller left to claim them they'd otherwise be misread as the
+// response to the next command sent. The Conn must not be used after this
+// happens.
+func (conn *Conn) CmdContext(ctx context.Context, cmd interface{}) (interface{}, error, bool) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.conn.SetWriteDeadline(deadline)
+		conn.conn.SetReadDeadline(deadline)
+		defer conn.conn.SetWriteDeadline(time.Time{})
+		defer conn.conn.SetReadDeadline(time.Time{})
+	}
+
+	// ch must be enqueued inside the writeMu critical section; see the
+	// comment in cmd.
+	conn.writeMu.Lock()
+	ch := conn.enqueue()
+	err, die := conn.client.Write(conn.buf.Writer, cmd)
+	if err == nil {
+		if err = conn.buf.Writer.Flush(); err != nil {
+			die = true
+		}
+	}
+	conn.writeMu.Unlock()
+
+	if err != nil {
+		conn.cancel(ch)
+		return nil, err, die
+	}
+	conn.touch()
+
+	select {
+	case rw := <-ch:
+		return rw.item, rw.err, rw.die
+	case <-ctx.Done():
+		conn.cancel(ch)
+		conn.Close()
+		return nil, ctx.Err(), true
+	}
+}
+
+// inFlightSem lazily allocates the semaphore used to enforce MaxInFlight, or
+// returns nil if no limit has been configured.
+func (conn *Conn) inFlightSem() chan struct{} {
+	if conn.MaxInFlight <= 0 {
+		return nil
+	}
+	conn.semOnce.Do(func() {
+		conn.sem = make(chan struct{}, conn.MaxInFlight)
+	})
+	return conn.sem
+}
+
+// CmdPipelined behaves exactly like Cmd, except that it's intended to be
+// called concurrently from many go-routines at once. Commands are written to
+// the connection as soon as the internal write lock can be acquired, without
+// waiting on previous calls' responses, and the responses are matched back up
+// to their caller in the order the commands were written.
+//
+// If MaxInFlight has been set on the Conn, CmdPipelined blocks until fewer
+// than MaxInFlight CmdPipelined calls are awaiting a response, to bound how
+// far ahead of the server the client is allowed to get. Commands sent
+// through Cmd, CmdContext, CmdBg or StartPing's pings are not counted.
+//
+// CmdPipelined assumes every command it's given gets exactly one response:
+// it relies on doc.go's first point not applying to whatever protocol it's
+// used with. Don't mix it with a command the server may not respond to (per
+// ServerClient.HandleCmd's sendback), and don't mix it with CmdBg on the
+// same Conn unless every command the two of them send is guaranteed a
+// response, since neither side can tell which ticket a given response was
+// actually meant for.
+func (conn *Conn) CmdPipelined(cmd interface{}) (interface{}, error, bool) {
+	if sem := conn.inFlightSem(); sem != nil {
+		sem <- struct{}{}
+		defer func() { <-sem }()
+	}
+	return conn.cmd(cmd, false)
+}
+
+// Similar to Cmd, but doesn't wait for a response: this is the fire-and-
+// forget path for a command the server isn't expected to reply to (see
+// doc.go and ServerClient.HandleCmd's sendback return). CmdBg will still
+// block to find out if there are any errors when reading/writing/
+// marshalling the command itself.
+//
+// CmdBg does not take a ticket on the pending queue, since it has no way of
+// knowing whether the server will answer this particular command; if the
+// server does respond to it anyway, that response will be misdelivered to
+// whichever Cmd/CmdPipelined call happens to be waiting on the oldest
+// ticket at the time. Only use CmdBg for commands the protocol guarantees
+// go unanswered.
 func (conn *Conn) CmdBg(cmd interface{}) (error, bool) {
 	_, err, die := conn.cmd(cmd, true)
 	return err, die
@@ -127,3 +447,45 @@ func (conn *Conn) Close() error {
 	// This will cause Read to fail and cleanup on its own.
 	return conn.conn.Close()
 }
+
+// StartPing launches a background go-routine which keeps the connection
+// alive by sending the item from the Client's Ping method as a command,
+// whenever the connection has been idle (no Cmd/CmdPipelined/CmdContext/
+// CmdBg call) for at least interval. It does nothing if the Client given to
+// Dial doesn't implement Pinger. The go-routine exits once the Conn dies.
+//
+// The ping goes through the same write lock and response queue as
+// Cmd/CmdPipelined, so it's safe to run alongside those. It is not safe to
+// run alongside CmdContext: CmdContext's deadline is connection-global (see
+// its doc comment), and the background ping may write or read while that
+// deadline is set, same as any other concurrent call would.
+func (conn *Conn) StartPing(interval time.Duration) {
+	pinger, ok := conn.client.(Pinger)
+	if !ok {
+		return
+	}
+	go conn.pingLoop(pinger, interval)
+}
+
+func (conn *Conn) pingLoop(pinger Pinger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if conn.idleSince() < interval {
+				continue
+			}
+			// The ping must take a ticket of its own rather than go through
+			// CmdBg: respond always hands the next read to the oldest
+			// pending ticket regardless of bg, so a ticketless ping ack
+			// would get matched to whatever unrelated Cmd/CmdPipelined call
+			// happens to be waiting, stealing its response.
+			if _, _, die := conn.cmd(pinger.Ping(), false); die {
+				return
+			}
+		case <-conn.done:
+			return
+		}
+	}
+}
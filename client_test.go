@@ -0,0 +1,439 @@
+package manatcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lineClient is a minimal newline-delimited Client used by the tests in
+// this file; it never produces push messages.
+type lineClient struct{}
+
+func (lineClient) Read(r *bufio.Reader) (interface{}, error, bool) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err, true
+	}
+	return bytes.TrimRight(line, "\n"), nil, false
+}
+
+func (lineClient) IsPush(interface{}) bool { return false }
+
+func (lineClient) Write(w *bufio.Writer, item interface{}) (error, bool) {
+	if _, err := w.Write(item.([]byte)); err != nil {
+		return err, true
+	}
+	if err := w.WriteByte('\n'); err != nil {
+		return err, true
+	}
+	return nil, false
+}
+
+// fakeLineEchoServer reads newline-delimited lines off conn and echoes each
+// one straight back, strictly in the order it read them, the way most
+// line-oriented protocols behave.
+func fakeLineEchoServer(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		if _, err := w.Write(line); err != nil {
+			return
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// TestCmdPipelinedOrdering guards against responses getting matched up to
+// the wrong caller when many go-routines call CmdPipelined concurrently: a
+// fake server which echoes strictly in the order it receives commands means
+// any caller seeing back something other than what it sent indicates the
+// pending-response queue got out of sync with the order writes actually hit
+// the wire.
+func TestCmdPipelinedOrdering(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	go fakeLineEchoServer(serverSide)
+
+	conn, err := DialConn(lineClient{}, clientSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		for range conn.PushCh {
+		}
+	}()
+
+	const n = 50
+	var wg sync.WaitGroup
+	errCh := make(chan string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			want := strconv.Itoa(i)
+			got, err, die := conn.CmdPipelined([]byte(want))
+			if err != nil || die {
+				errCh <- fmt.Sprintf("cmd %d: unexpected error/die: %v/%v", i, err, die)
+				return
+			}
+			if got := string(got.([]byte)); got != want {
+				errCh <- fmt.Sprintf("cmd %d got response %q", i, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+
+	for e := range errCh {
+		t.Error(e)
+	}
+}
+
+// TestCmdContextSucceedsWithinDeadline checks the ordinary path: a response
+// that arrives before ctx's deadline is returned normally.
+func TestCmdContextSucceedsWithinDeadline(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	go fakeLineEchoServer(serverSide)
+
+	conn, err := DialConn(lineClient{}, clientSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		for range conn.PushCh {
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	got, err, die := conn.CmdContext(ctx, []byte("hi"))
+	if err != nil || die {
+		t.Fatalf("unexpected error/die: %v/%v", err, die)
+	}
+	if got := string(got.([]byte)); got != "hi" {
+		t.Fatalf("got %q, want %q", got, "hi")
+	}
+}
+
+// TestCmdContextCancelledBeforeResponse checks that CmdContext returns
+// ctx.Err() and closes the Conn, rather than hanging, when ctx is done
+// before the server ever responds. The context here is cancelled rather
+// than given a deadline so the test isn't also racing CmdContext's own
+// SetReadDeadline/SetWriteDeadline calls, which are tied to ctx's deadline
+// and would otherwise fire at the same wall-clock instant as ctx.Done().
+func TestCmdContextCancelledBeforeResponse(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer serverSide.Close()
+
+	// Read the command off the wire so the client's Write completes, but
+	// never send a response back.
+	go bufio.NewReader(serverSide).ReadBytes('\n')
+
+	conn, err := DialConn(lineClient{}, clientSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range conn.PushCh {
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err, die := conn.CmdContext(ctx, []byte("hi"))
+	if err != ctx.Err() {
+		t.Fatalf("got err %v, want %v", err, ctx.Err())
+	}
+	if !die {
+		t.Fatal("expected die to be true")
+	}
+}
+
+// pingClient extends lineClient with a Pinger implementation, for testing
+// StartPing. Its ping is a plain command indistinguishable on the wire from
+// any other, the same as a Redis-style PING/PONG heartbeat would be.
+type pingClient struct{ lineClient }
+
+func (pingClient) Ping() interface{} { return []byte("PING") }
+
+// fakePingReplyServer behaves like fakeLineEchoServer, except it answers a
+// "PING" line with "PONG" instead of echoing it back, the way a typical
+// ping/pong heartbeat protocol would.
+func fakePingReplyServer(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		resp := line
+		if bytes.Equal(bytes.TrimRight(line, "\n"), []byte("PING")) {
+			resp = []byte("PONG\n")
+		}
+		if _, err := w.Write(resp); err != nil {
+			return
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// TestStartPingDoesNotStealResponses guards against a ping's ack being
+// matched to an unrelated, concurrently outstanding Cmd/CmdPipelined call: if
+// the ping doesn't take a ticket of its own, respond hands its PONG to
+// whoever's ticket is oldest, and that caller's real response is then lost.
+func TestStartPingDoesNotStealResponses(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	go fakePingReplyServer(serverSide)
+
+	conn, err := DialConn(pingClient{}, clientSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		for range conn.PushCh {
+		}
+	}()
+
+	conn.StartPing(time.Millisecond)
+
+	// Keep enough CmdPipelined traffic flowing, for long enough, that the
+	// 1ms ping interval is guaranteed to tick several times while calls are
+	// outstanding: a ping that only ever fires between bursts would never
+	// exercise the race this test is after.
+	const n = 20
+	deadline := time.Now().Add(200 * time.Millisecond)
+	var wg sync.WaitGroup
+	errCh := make(chan string, n*1000)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			want := strconv.Itoa(i)
+			for time.Now().Before(deadline) {
+				got, err, die := conn.CmdPipelined([]byte(want))
+				if err != nil || die {
+					errCh <- fmt.Sprintf("cmd %d: unexpected error/die: %v/%v", i, err, die)
+					return
+				}
+				if got := string(got.([]byte)); got != want {
+					errCh <- fmt.Sprintf("cmd %d got response %q", i, got)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+
+	for e := range errCh {
+		t.Error(e)
+	}
+}
+
+// fakeLineEchoServerDroppingCmd behaves like fakeLineEchoServer, except it
+// silently drops any line equal to drop instead of echoing it back, the way
+// a command the server doesn't answer (HandleCmd's sendback return false;
+// see doc.go) never gets a response on the wire.
+func fakeLineEchoServerDroppingCmd(conn net.Conn, drop string) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		if string(bytes.TrimRight(line, "\n")) == drop {
+			continue
+		}
+		if _, err := w.Write(line); err != nil {
+			return
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// TestCmdBgDoesNotStealResponses guards against CmdBg's ticket-free,
+// fire-and-forget send desyncing the pending-response queue. This exercises
+// CmdBg's actual use case: a command the server never responds to. If cmd
+// enqueued a ticket for it anyway, that ticket would never pop, and the
+// following Cmd call's real response would be misdelivered to it instead,
+// hanging Cmd forever.
+func TestCmdBgDoesNotStealResponses(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	go fakeLineEchoServerDroppingCmd(serverSide, "bg")
+
+	conn, err := DialConn(lineClient{}, clientSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		for range conn.PushCh {
+		}
+	}()
+
+	if err, die := conn.CmdBg([]byte("bg")); err != nil || die {
+		t.Fatalf("CmdBg: unexpected error/die: %v/%v", err, die)
+	}
+
+	type result struct {
+		item interface{}
+		err  error
+		die  bool
+	}
+	cmdDone := make(chan result, 1)
+	go func() {
+		item, err, die := conn.Cmd([]byte("hello"))
+		cmdDone <- result{item, err, die}
+	}()
+
+	select {
+	case res := <-cmdDone:
+		if res.err != nil || res.die {
+			t.Fatalf("Cmd: unexpected error/die: %v/%v", res.err, res.die)
+		}
+		if s := string(res.item.([]byte)); s != "hello" {
+			t.Fatalf("got %q, want %q", s, "hello")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Cmd hung, its response was likely stolen by CmdBg's dropped-response ticket")
+	}
+}
+
+// genSelfSignedCert generates a throwaway self-signed certificate for
+// ServerName "manatcp-test", for use as the server side of the DialWithOpts
+// TLS tests below.
+func genSelfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "manatcp-test"},
+		DNSNames:     []string{"manatcp-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+// pipeDialer is a Dialer (see DialWithOpts) that hands back one side of an
+// in-memory net.Pipe and runs fn against the other side, so DialWithOpts can
+// be tested without a real listener.
+type pipeDialer struct {
+	fn func(serverSide net.Conn)
+}
+
+func (d pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	clientSide, serverSide := net.Pipe()
+	go d.fn(serverSide)
+	return clientSide, nil
+}
+
+// TestDialWithOptsTLSHandshakeSucceeds checks the ordinary path: a
+// DialOpts.TLSConfig that trusts the server's certificate dials
+// successfully via a custom Dialer.
+func TestDialWithOptsTLSHandshakeSucceeds(t *testing.T) {
+	cert := genSelfSignedCert(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	dialer := pipeDialer{fn: func(serverSide net.Conn) {
+		tls.Server(serverSide, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+	}}
+
+	conn, err := DialWithOpts(lineClient{}, "tcp", "ignored", DialOpts{
+		Dialer:    dialer,
+		TLSConfig: &tls.Config{ServerName: "manatcp-test", RootCAs: pool},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+// TestDialWithOptsTLSHandshakeFailureIsReturned guards against DialWithOpts
+// wrapping the connection in tls.Client without performing the handshake:
+// tls.Client alone doesn't validate the server's certificate until the
+// first Read/Write, so an untrusted certificate would otherwise make
+// DialWithOpts return a Conn that just hangs on its first Cmd instead of
+// surfacing the handshake failure here.
+func TestDialWithOptsTLSHandshakeFailureIsReturned(t *testing.T) {
+	cert := genSelfSignedCert(t)
+
+	dialer := pipeDialer{fn: func(serverSide net.Conn) {
+		tls.Server(serverSide, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+	}}
+
+	// No RootCAs given, so the client won't trust cert.
+	_, err := DialWithOpts(lineClient{}, "tcp", "ignored", DialOpts{
+		Dialer:    dialer,
+		TLSConfig: &tls.Config{ServerName: "manatcp-test"},
+	})
+	if err == nil {
+		t.Fatal("expected an error from the TLS handshake, got nil")
+	}
+}
+
+// TestDialWithOptsHandshakeTimeout checks that a stalled TLS handshake
+// (peer accepts the connection but never completes it) is bounded by
+// HandshakeTimeout instead of blocking DialWithOpts forever.
+func TestDialWithOptsHandshakeTimeout(t *testing.T) {
+	dialer := pipeDialer{fn: func(serverSide net.Conn) {
+		// Accept the connection but never speak TLS back, so the client's
+		// handshake never completes on its own.
+		<-make(chan struct{})
+	}}
+
+	_, err := DialWithOpts(lineClient{}, "tcp", "ignored", DialOpts{
+		Dialer:           dialer,
+		TLSConfig:        &tls.Config{ServerName: "manatcp-test"},
+		HandshakeTimeout: 20 * time.Millisecond,
+	})
+	if err == nil {
+		t.Fatal("expected a timeout error, got nil")
+	}
+}
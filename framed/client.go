@@ -0,0 +1,46 @@
+package framed
+
+import (
+	"bufio"
+
+	"github.com/mediocregopher/manatcp"
+)
+
+// Handler supplies the one piece of protocol logic NewFramedClient can't
+// infer from a Codec alone: whether a given payload is a push message.
+type Handler interface {
+	// IsPush returns whether the given payload is a push message, as
+	// opposed to a command response.
+	IsPush(payload []byte) bool
+}
+
+type framedClient struct {
+	codec   Codec
+	handler Handler
+}
+
+// NewFramedClient builds a manatcp.Client which delegates all framing to
+// codec, handing handler (and the resulting Conn's callers) only the raw
+// payload []byte of each message.
+func NewFramedClient(codec Codec, handler Handler) manatcp.Client {
+	return &framedClient{codec: codec, handler: handler}
+}
+
+func (fc *framedClient) Read(r *bufio.Reader) (interface{}, error, bool) {
+	b, err := fc.codec.ReadFrame(r)
+	if err != nil {
+		return nil, err, true
+	}
+	return b, nil, false
+}
+
+func (fc *framedClient) IsPush(item interface{}) bool {
+	return fc.handler.IsPush(item.([]byte))
+}
+
+func (fc *framedClient) Write(w *bufio.Writer, item interface{}) (error, bool) {
+	if err := fc.codec.WriteFrame(w, item.([]byte)); err != nil {
+		return err, true
+	}
+	return nil, false
+}
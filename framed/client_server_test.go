@@ -0,0 +1,81 @@
+package framed
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mediocregopher/manatcp"
+)
+
+// echoHandler is a ServerHandler which echoes back whatever payload it's
+// handed, used to exercise NewFramedServer's wiring of a ServerHandler into
+// a manatcp.Server.
+type echoHandler struct{}
+
+func (echoHandler) HandleCmd(payload []byte) ([]byte, bool, bool) {
+	return payload, true, false
+}
+
+func (echoHandler) Closing() {}
+
+type echoFactory struct{}
+
+func (echoFactory) Connected(*manatcp.ListenerConn) (ServerHandler, bool) {
+	return echoHandler{}, false
+}
+
+// neverPushHandler is the Handler used by the client side of the test below;
+// none of the payloads it sees back are push messages.
+type neverPushHandler struct{}
+
+func (neverPushHandler) IsPush([]byte) bool { return false }
+
+// TestFramedClientServerRoundTrip drives a payload through NewFramedClient
+// against NewFramedServer, for each Codec, over a real TCP connection. This
+// is the headline deliverable of this package: codec_test.go already
+// exercises the Codecs directly, but not the wiring that turns one into a
+// manatcp.Client/Server.
+func TestFramedClientServerRoundTrip(t *testing.T) {
+	codecs := []struct {
+		name  string
+		codec Codec
+	}{
+		{"LengthPrefixed32", LengthPrefixed32{}},
+		{"LengthPrefixedVarint", LengthPrefixedVarint{}},
+		{"Delimited", Delimited('\n')},
+		{"Netstring", Netstring{}},
+	}
+
+	for _, c := range codecs {
+		t.Run(c.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err := manatcp.Serve(NewFramedServer(c.codec, echoFactory{}), ln)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			conn, err := manatcp.Dial(NewFramedClient(c.codec, neverPushHandler{}), ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			go func() {
+				for range conn.PushCh {
+				}
+			}()
+
+			payload := []byte("hello framed world")
+			got, err, die := conn.Cmd(payload)
+			if err != nil || die {
+				t.Fatalf("unexpected error/die: %v/%v", err, die)
+			}
+			if gotB := got.([]byte); string(gotB) != string(payload) {
+				t.Fatalf("got %q, want %q", gotB, payload)
+			}
+		})
+	}
+}
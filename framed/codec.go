@@ -0,0 +1,201 @@
+/*
+Package framed provides Codec implementations for the most common
+message-framing schemes (length-prefixed, delimited, netstring), plus
+helpers for wiring any Codec up as a manatcp.Client or manatcp.Server.
+
+Without this package, every user of manatcp has to hand-roll framing on top
+of the bufio.Reader/bufio.Writer handed to Client.Read/Write and
+ServerClient.Read/Write. NewFramedClient and NewFramedServer take care of
+that, handing the caller only the raw payload []byte of each message.
+*/
+package framed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// defaultMaxFrameSize is the frame size limit used by the length-prefixed
+// and netstring Codecs when MaxSize isn't set, to keep a peer from forcing
+// an arbitrarily large allocation with a crafted length prefix.
+const defaultMaxFrameSize = 32 * 1024 * 1024 // 32MiB
+
+// checkFrameSize returns an error if n, the frame size taken off the wire,
+// exceeds max (or defaultMaxFrameSize, if max is 0). It's checked before any
+// allocation sized by n.
+func checkFrameSize(n uint64, max int) error {
+	if max <= 0 {
+		max = defaultMaxFrameSize
+	}
+	if n > uint64(max) {
+		return fmt.Errorf("framed: frame size %d exceeds max of %d", n, max)
+	}
+	return nil
+}
+
+// Codec reads and writes a single framed message from/to a bufio.Reader or
+// bufio.Writer, handling whatever length-prefixing or delimiting scheme it
+// implements.
+type Codec interface {
+	// ReadFrame reads a single frame off of r and returns its payload.
+	ReadFrame(r *bufio.Reader) ([]byte, error)
+
+	// WriteFrame writes b to w as a single frame. The caller is responsible
+	// for flushing w afterwards.
+	WriteFrame(w *bufio.Writer, b []byte) error
+}
+
+// LengthPrefixed32 is a Codec which frames messages with a 4-byte
+// big-endian length prefix.
+type LengthPrefixed32 struct {
+	// Pool, if set, is used to allocate the payload []byte returned by
+	// ReadFrame, instead of allocating one fresh for every message. Callers
+	// which want the benefit of this must return the payload to the Pool
+	// themselves (via Pool.Put) once they're done with it.
+	Pool *BufferPool
+
+	// MaxSize caps the frame size ReadFrame will allocate for, rejecting
+	// anything larger with an error rather than trusting the wire. Zero
+	// means defaultMaxFrameSize.
+	MaxSize int
+}
+
+func (c LengthPrefixed32) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if err := checkFrameSize(uint64(n), c.MaxSize); err != nil {
+		return nil, err
+	}
+	b := c.Pool.alloc(int(n))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (LengthPrefixed32) WriteFrame(w *bufio.Writer, b []byte) error {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(b)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// LengthPrefixedVarint is a Codec which frames messages with a unsigned
+// varint length prefix (see encoding/binary's Uvarint), rather than a fixed
+// 4 bytes, so small messages cost less framing overhead.
+type LengthPrefixedVarint struct {
+	// Pool, if set, is used to allocate the payload []byte returned by
+	// ReadFrame, instead of allocating one fresh for every message. Callers
+	// which want the benefit of this must return the payload to the Pool
+	// themselves (via Pool.Put) once they're done with it.
+	Pool *BufferPool
+
+	// MaxSize caps the frame size ReadFrame will allocate for, rejecting
+	// anything larger with an error rather than trusting the wire. Zero
+	// means defaultMaxFrameSize.
+	MaxSize int
+}
+
+func (c LengthPrefixedVarint) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFrameSize(n, c.MaxSize); err != nil {
+		return nil, err
+	}
+	b := c.Pool.alloc(int(n))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (LengthPrefixedVarint) WriteFrame(w *bufio.Writer, b []byte) error {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(b)))
+	if _, err := w.Write(lenBuf[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// Delimited is a Codec which frames messages by a single trailing delimiter
+// byte (e.g. '\n'), as used by plenty of line-oriented protocols. The
+// delimiter itself is stripped from the payload on read, and must not
+// appear within a payload passed to WriteFrame.
+type Delimited byte
+
+func (d Delimited) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	b, err := r.ReadBytes(byte(d))
+	if err != nil {
+		return nil, err
+	}
+	return b[:len(b)-1], nil
+}
+
+func (d Delimited) WriteFrame(w *bufio.Writer, b []byte) error {
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	return w.WriteByte(byte(d))
+}
+
+// Netstring is a Codec which frames messages using D. J. Bernstein's
+// netstring format: the ascii decimal length, a colon, the payload, and a
+// trailing comma (e.g. "5:hello,").
+type Netstring struct {
+	// MaxSize caps the frame size ReadFrame will allocate for, rejecting
+	// anything larger with an error rather than trusting the wire. Zero
+	// means defaultMaxFrameSize.
+	MaxSize int
+}
+
+func (c Netstring) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	lenStr, err := r.ReadString(':')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseUint(lenStr[:len(lenStr)-1], 10, 64)
+	if err != nil {
+		return nil, errors.New("framed: netstring has invalid length prefix")
+	}
+	if err := checkFrameSize(n, c.MaxSize); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	comma, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	} else if comma != ',' {
+		return nil, errors.New("framed: netstring missing trailing comma")
+	}
+	return b, nil
+}
+
+func (Netstring) WriteFrame(w *bufio.Writer, b []byte) error {
+	if _, err := io.WriteString(w, strconv.Itoa(len(b))); err != nil {
+		return err
+	}
+	if err := w.WriteByte(':'); err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	return w.WriteByte(',')
+}
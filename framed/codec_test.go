@@ -0,0 +1,105 @@
+package framed
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// TestReadFrameRejectsOversizedLength guards against a peer crashing the
+// process by sending a frame-length prefix with no payload to back it: each
+// Codec must return an error from ReadFrame instead of attempting the
+// allocation (and, in LengthPrefixedVarint's case, instead of overflowing
+// int(n) into a negative length and panicking in make/append).
+func TestReadFrameRejectsOversizedLength(t *testing.T) {
+	cases := []struct {
+		name  string
+		codec Codec
+		wire  []byte
+	}{
+		{
+			name:  "LengthPrefixed32 over default max",
+			codec: LengthPrefixed32{},
+			wire:  []byte{0xff, 0xff, 0xff, 0xff}, // ~4GiB
+		},
+		{
+			name:  "LengthPrefixed32 over custom max",
+			codec: LengthPrefixed32{MaxSize: 10},
+			wire:  []byte{0x00, 0x00, 0x00, 0x0b}, // 11
+		},
+		{
+			name:  "LengthPrefixedVarint over default max",
+			codec: LengthPrefixedVarint{},
+			wire:  varint(1 << 40),
+		},
+		{
+			name:  "LengthPrefixedVarint at MaxUint64",
+			codec: LengthPrefixedVarint{},
+			wire:  varint(^uint64(0)),
+		},
+		{
+			name:  "Netstring over default max",
+			codec: Netstring{},
+			wire:  []byte("99999999999:"),
+		},
+		{
+			name:  "Netstring over custom max",
+			codec: Netstring{MaxSize: 10},
+			wire:  []byte("11:"),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(c.wire))
+			if _, err := c.codec.ReadFrame(r); err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+		})
+	}
+}
+
+// TestReadFrameAcceptsSizeWithinMax checks that ReadFrame still round-trips
+// frames at or under the configured max, so the bound above doesn't reject
+// legitimate traffic.
+func TestReadFrameAcceptsSizeWithinMax(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 10)
+
+	cases := []struct {
+		name  string
+		codec Codec
+	}{
+		{"LengthPrefixed32", LengthPrefixed32{MaxSize: 10}},
+		{"LengthPrefixedVarint", LengthPrefixedVarint{MaxSize: 10}},
+		{"Netstring", Netstring{MaxSize: 10}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := bufio.NewWriter(&buf)
+			if err := c.codec.WriteFrame(w, payload); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := bufio.NewReader(&buf)
+			got, err := c.codec.ReadFrame(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("got %q, want %q", got, payload)
+			}
+		})
+	}
+}
+
+func varint(n uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	l := binary.PutUvarint(buf[:], n)
+	return buf[:l]
+}
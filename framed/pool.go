@@ -0,0 +1,37 @@
+package framed
+
+import "sync"
+
+// BufferPool pools []byte buffers for reuse across frame reads, to cut down
+// on allocations for high-throughput connections. The zero value is ready
+// to use. A nil *BufferPool is also valid and simply never reuses anything.
+type BufferPool struct {
+	pool sync.Pool
+}
+
+// Get returns a []byte of length n, reused from the pool if one of
+// sufficient capacity is available, or freshly allocated otherwise.
+func (p *BufferPool) Get(n int) []byte {
+	return p.alloc(n)
+}
+
+// Put returns b to the pool, to be handed out by a future Get/alloc. The
+// caller must not use b again after calling Put.
+func (p *BufferPool) Put(b []byte) {
+	if p == nil {
+		return
+	}
+	p.pool.Put(b)
+}
+
+func (p *BufferPool) alloc(n int) []byte {
+	if p == nil {
+		return make([]byte, n)
+	}
+	if v := p.pool.Get(); v != nil {
+		if b := v.([]byte); cap(b) >= n {
+			return b[:n]
+		}
+	}
+	return make([]byte, n)
+}
@@ -0,0 +1,74 @@
+package framed
+
+import (
+	"bufio"
+
+	"github.com/mediocregopher/manatcp"
+)
+
+// ServerHandler supplies the per-connection protocol logic NewFramedServer
+// needs, mirroring manatcp.ServerClient but working with raw payload []byte
+// instead of interface{}; framing is handled for it by the Codec given to
+// NewFramedServer.
+type ServerHandler interface {
+	// HandleCmd is called with a single request payload once it's been read
+	// and unframed. It mirrors manatcp.ServerClient.HandleCmd: the response
+	// payload to write back (meaningless if sendback is false), whether to
+	// send it, and whether to close the connection.
+	HandleCmd(payload []byte) (resp []byte, sendback, die bool)
+
+	// Closing is called when the connection is closed for any reason.
+	Closing()
+}
+
+// ServerFactory constructs a ServerHandler for each new connection,
+// mirroring manatcp.Server.Connected.
+type ServerFactory interface {
+	Connected(*manatcp.ListenerConn) (ServerHandler, bool)
+}
+
+type framedServer struct {
+	codec   Codec
+	factory ServerFactory
+}
+
+// NewFramedServer builds a manatcp.Server which delegates all framing to
+// codec, handing factory's ServerHandlers only the raw payload []byte of
+// each message.
+func NewFramedServer(codec Codec, factory ServerFactory) manatcp.Server {
+	return &framedServer{codec: codec, factory: factory}
+}
+
+func (fs *framedServer) Connected(lc *manatcp.ListenerConn) (manatcp.ServerClient, bool) {
+	h, die := fs.factory.Connected(lc)
+	if die {
+		return nil, true
+	}
+	return &framedServerClient{codec: fs.codec, handler: h}, false
+}
+
+type framedServerClient struct {
+	codec   Codec
+	handler ServerHandler
+}
+
+func (fsc *framedServerClient) Read(r *bufio.Reader) (interface{}, bool) {
+	b, err := fsc.codec.ReadFrame(r)
+	if err != nil {
+		return nil, true
+	}
+	return b, false
+}
+
+func (fsc *framedServerClient) Write(w *bufio.Writer, item interface{}) bool {
+	return fsc.codec.WriteFrame(w, item.([]byte)) != nil
+}
+
+func (fsc *framedServerClient) HandleCmd(item interface{}) (interface{}, bool, bool) {
+	resp, sendback, die := fsc.handler.HandleCmd(item.([]byte))
+	return resp, sendback, die
+}
+
+func (fsc *framedServerClient) Closing() {
+	fsc.handler.Closing()
+}
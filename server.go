@@ -2,7 +2,11 @@ package manatcp
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"net"
+	"sync"
+	"time"
 )
 
 // Interface representing a tcp server which can accept new client connections.
@@ -50,12 +54,111 @@ type ServerClient interface {
 	Closing()
 }
 
+// PingOpts configures the application-level heartbeat a Listener sends to
+// idle connections, independent of the TCP-level keep-alive in ListenOpts.
+type PingOpts struct {
+	// Interval is how long a connection must sit idle (no command handled,
+	// no push sent, no ping outstanding) before a ping is sent to it. Zero
+	// disables pinging.
+	Interval time.Duration
+
+	// Timeout is how long to wait for any read from the client after a ping
+	// is sent before the connection is force-closed. If zero, Interval is
+	// used.
+	Timeout time.Duration
+}
+
 // A tcp server which can accept new client connections, and handle them through
 // a given Server interface.
 type Listener struct {
 	listen net.Listener
 	server Server
 	ErrCh  chan error
+
+	// Ping configures the idle-connection heartbeat sent to every accepted
+	// connection whose ServerClient implements Pinger. This must be set, if
+	// at all, before the Listener accepts its first connection.
+	Ping PingOpts
+
+	connsMu sync.Mutex
+	conns   map[*ListenerConn]struct{}
+
+	closedCh  chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Conns returns the ListenerConns currently live on this Listener, i.e. those
+// which have completed Connected and haven't yet finished closing. This can
+// be used to implement a custom idle-reaping policy alongside, or instead
+// of, Ping.
+func (l *Listener) Conns() []*ListenerConn {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	conns := make([]*ListenerConn, 0, len(l.conns))
+	for lc := range l.conns {
+		conns = append(conns, lc)
+	}
+	return conns
+}
+
+func (l *Listener) addConn(lc *ListenerConn) {
+	l.connsMu.Lock()
+	l.conns[lc] = struct{}{}
+	l.connsMu.Unlock()
+}
+
+func (l *Listener) removeConn(lc *ListenerConn) {
+	l.connsMu.Lock()
+	delete(l.conns, lc)
+	l.connsMu.Unlock()
+}
+
+// Close stops the Listener from accepting any new connections. It does not
+// touch connections already established; use Shutdown to drain those as
+// well. Close may be called more than once.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.closedCh) })
+	return l.listen.Close()
+}
+
+// Shutdown stops the Listener from accepting any new connections, same as
+// Close, and additionally asks every currently-live ListenerConn to finish
+// up: each ServerClient gets to complete any HandleCmd call already in
+// progress, and whatever's already sitting on its PushCh gets flushed on a
+// best-effort basis, before it closes on its own. This is not a hard
+// guarantee: a push racing with Shutdown can still be dropped, or can panic
+// the pushing go-routine if it lands as the connection finishes closing
+// (per PushCh's existing doc-comment, callers are expected to stop pushing
+// once they know a connection is going away). Shutdown waits for all
+// ListenerConns to finish, or for ctx to be done, whichever comes first. If
+// ctx finishes first, any connections still open are force-closed via
+// ListenerConn.Close, and Shutdown waits for them to finish closing before
+// it returns ctx.Err(); a HandleCmd call that never returns blocks that
+// wait.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.Close()
+
+	for _, lc := range l.Conns() {
+		lc.shutdown()
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+		return nil
+	case <-ctx.Done():
+		for _, lc := range l.Conns() {
+			lc.Close()
+		}
+		<-waited
+		return ctx.Err()
+	}
 }
 
 // Begins listening for client connections on the given address, using the given
@@ -65,16 +168,73 @@ func Listen(s Server, laddr string) (*Listener, error) {
 	if err != nil {
 		return nil, err
 	}
+	return Serve(s, ln)
+}
 
+// Serve begins accepting connections on an already-constructed net.Listener,
+// handling them via the given Server. This is the entry point for anything
+// Listen doesn't cover directly: TLS (wrap the listener with
+// tls.NewListener), Unix domain sockets, or an in-memory listener for tests.
+// See also ListenWithOpts, which covers the common TLS/keep-alive cases
+// without requiring the caller to construct the listener manually.
+func Serve(s Server, ln net.Listener) (*Listener, error) {
 	l := Listener{
-		listen: ln,
-		server: s,
-		ErrCh:  make(chan error),
+		listen:   ln,
+		server:   s,
+		ErrCh:    make(chan error),
+		conns:    map[*ListenerConn]struct{}{},
+		closedCh: make(chan struct{}),
 	}
 	go l.spin()
 	return &l, nil
 }
 
+// ListenOpts holds optional configuration for ListenWithOpts.
+type ListenOpts struct {
+	// TLSConfig, if set, causes every accepted connection to perform a TLS
+	// server handshake using this config before being handed to Server.
+	TLSConfig *tls.Config
+
+	// KeepAlive, if non-zero, is enabled with this period on every accepted
+	// *net.TCPConn.
+	KeepAlive time.Duration
+}
+
+// ListenWithOpts is like Listen, but listens over the given network (e.g.
+// "tcp", "unix") using the given ListenOpts to control TLS and keep-alive.
+func ListenWithOpts(s Server, network, laddr string, opts ListenOpts) (*Listener, error) {
+	ln, err := net.Listen(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	if opts.KeepAlive != 0 {
+		ln = &keepAliveListener{ln, opts.KeepAlive}
+	}
+	if opts.TLSConfig != nil {
+		ln = tls.NewListener(ln, opts.TLSConfig)
+	}
+	return Serve(s, ln)
+}
+
+// keepAliveListener wraps a net.Listener so that every accepted *net.TCPConn
+// has keep-alive enabled with the given period.
+type keepAliveListener struct {
+	net.Listener
+	keepAlive time.Duration
+}
+
+func (ln *keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tconn, ok := conn.(*net.TCPConn); ok {
+		tconn.SetKeepAlive(true)
+		tconn.SetKeepAlivePeriod(ln.keepAlive)
+	}
+	return conn, nil
+}
+
 func (l *Listener) err(err error) {
 	select {
 	case l.ErrCh <- err:
@@ -86,21 +246,39 @@ func (l *Listener) spin() {
 	for {
 		conn, err := l.listen.Accept()
 		if err != nil {
+			select {
+			case <-l.closedCh:
+				return
+			default:
+			}
 			l.err(err)
 			continue
 		}
 		rbuf := bufio.NewReader(conn)
 		wbuf := bufio.NewWriter(conn)
 		lc := ListenerConn{
-			conn:    conn,
-			buf:     bufio.NewReadWriter(rbuf, wbuf),
-			CloseCh: make(chan struct{}),
-			PushCh:  make(chan interface{}),
+			conn:         conn,
+			buf:          bufio.NewReadWriter(rbuf, wbuf),
+			CloseCh:      make(chan struct{}),
+			PushCh:       make(chan interface{}),
+			shutdownCh:   make(chan struct{}),
+			ping:         l.Ping,
+			lastActivity: time.Now(),
 		}
 		var die bool
 		lc.serverClient, die = l.server.Connected(&lc)
 		if !die {
-			go lc.spin()
+			// wg.Add must happen before addConn: Shutdown calls Conns (which
+			// can already see lc below) before it starts waiting on wg, so
+			// Add-ing after addConn would let Wait observe the counter at 0
+			// and return while lc is still live.
+			l.wg.Add(1)
+			l.addConn(&lc)
+			go func() {
+				lc.spin()
+				l.removeConn(&lc)
+				l.wg.Done()
+			}()
 		} else {
 			conn.Close()
 		}
@@ -119,9 +297,48 @@ type ListenerConn struct {
 	// safely, up until Closing is called on the associated ServerClient. As
 	// soon as that method returns pushing to this channel will cause a panic.
 	PushCh chan interface{}
+
+	// shutdownCh is closed by shutdown to ask spin to finish up and close on
+	// its own, as opposed to CloseCh which forces an immediate close.
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
+	closeOnce    sync.Once
+
+	ping PingOpts
+
+	activityMu   sync.Mutex
+	lastActivity time.Time
+
+	// readWG tracks the single in-flight read go-routine spin launches, so
+	// spin's cleanup can wait for it to return before nil-ing serverClient
+	// out from under it.
+	readWG sync.WaitGroup
+}
+
+// shutdown asks the connection to finish any in-flight command handling and
+// then close on its own, without forcing an immediate close like Close does.
+func (lc *ListenerConn) shutdown() {
+	lc.shutdownOnce.Do(func() { close(lc.shutdownCh) })
+}
+
+// LastActivity returns the last time a command was handled or a push was
+// sent on this connection (not counting pings sent by the Ping heartbeat
+// itself). This can be used to implement a custom idle-reaping policy
+// alongside, or instead of, Listener.Ping.
+func (lc *ListenerConn) LastActivity() time.Time {
+	lc.activityMu.Lock()
+	defer lc.activityMu.Unlock()
+	return lc.lastActivity
+}
+
+func (lc *ListenerConn) touch() {
+	lc.activityMu.Lock()
+	lc.lastActivity = time.Now()
+	lc.activityMu.Unlock()
 }
 
 func (lc *ListenerConn) read(readCh chan *readWrap) {
+	defer lc.readWG.Done()
 	item, die := lc.serverClient.Read(lc.buf.Reader)
 	select {
 	case readCh <- &readWrap{item, nil, die}:
@@ -129,6 +346,20 @@ func (lc *ListenerConn) read(readCh chan *readWrap) {
 	}
 }
 
+// resetIdleTimer reuses t for another wait of length d, following the
+// stop-drain-reset idiom: if t already fired and its tick is sitting unread
+// in t.C, that tick is drained here first so it can't be mistaken for a new
+// one and fire a spurious ping on the next iteration.
+func resetIdleTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
 func (lc *ListenerConn) groundPushCh(done chan struct{}) {
 	for {
 		select {
@@ -153,9 +384,19 @@ func (lc *ListenerConn) spin() {
 	readCh := make(chan *readWrap)
 	needsRead := true
 
+	var pingTimer *time.Timer
+	var pingTimerCh <-chan time.Time
+	var pingOutstanding bool
+	if lc.ping.Interval > 0 {
+		pingTimer = time.NewTimer(lc.ping.Interval)
+		pingTimerCh = pingTimer.C
+		defer pingTimer.Stop()
+	}
+
 spinloop:
 	for {
 		if needsRead {
+			lc.readWG.Add(1)
 			go lc.read(readCh)
 			needsRead = false
 		}
@@ -163,9 +404,14 @@ spinloop:
 		select {
 		case rw := <-readCh:
 			needsRead = true
+			pingOutstanding = false
+			if pingTimer != nil {
+				resetIdleTimer(pingTimer, lc.ping.Interval)
+			}
 			if rw.die {
 				break spinloop
 			}
+			lc.touch()
 			var dieCmd, dieWrite bool
 			res, sendback, dieCmd := lc.serverClient.HandleCmd(rw.item)
 			if sendback {
@@ -176,12 +422,56 @@ spinloop:
 			}
 
 		case item := <-lc.PushCh:
+			lc.touch()
+			// Only push the idle timer back out if a ping isn't already
+			// outstanding: this push proves the connection can still be
+			// written to, but it's one-way and gets no ack, so it must not
+			// also extend the window a genuinely outstanding ping is
+			// waiting on a response within.
+			if pingTimer != nil && !pingOutstanding {
+				resetIdleTimer(pingTimer, lc.ping.Interval)
+			}
 			if die := lc.write(item); die {
 				break spinloop
 			}
 
+		case <-pingTimerCh:
+			if pingOutstanding {
+				break spinloop
+			}
+			pinger, ok := lc.serverClient.(Pinger)
+			if !ok {
+				resetIdleTimer(pingTimer, lc.ping.Interval)
+				continue
+			}
+			if die := lc.write(pinger.Ping()); die {
+				break spinloop
+			}
+			pingOutstanding = true
+			timeout := lc.ping.Timeout
+			if timeout <= 0 {
+				timeout = lc.ping.Interval
+			}
+			resetIdleTimer(pingTimer, timeout)
+
 		case <-lc.CloseCh:
 			break spinloop
+
+		case <-lc.shutdownCh:
+			// Drain whatever's already sitting on PushCh before exiting, on
+			// a best-effort basis: this shrinks, but can't fully close, the
+			// race against a concurrent send on PushCh (see shutdown's
+			// doc-comment).
+			for {
+				select {
+				case item := <-lc.PushCh:
+					if die := lc.write(item); die {
+						break spinloop
+					}
+				default:
+					break spinloop
+				}
+			}
 		}
 	}
 
@@ -191,7 +481,13 @@ spinloop:
 	lc.conn.Close()
 	close(doneClosing)
 	close(lc.PushCh)
-	close(lc.CloseCh)
+	lc.closeOnce.Do(func() { close(lc.CloseCh) })
+
+	// The last read go-routine spin launched may not have reached its call
+	// to lc.serverClient.Read yet (it was only just scheduled when spin
+	// broke out above); wait for it to finish before nil-ing serverClient
+	// out from under it.
+	lc.readWG.Wait()
 	lc.serverClient = nil
 
 }
@@ -199,5 +495,14 @@ spinloop:
 // Force close the client connection. This method can be called by any number of
 // go-routines safely.
 func (lc *ListenerConn) Close() {
-	close(lc.CloseCh)
+	lc.closeOnce.Do(func() {
+		close(lc.CloseCh)
+		// Close the underlying conn directly too, rather than relying on
+		// spin to notice CloseCh: spin only selects on CloseCh while it's
+		// parked in its select loop, but it can also be blocked in a stalled
+		// Write/Flush, which would otherwise never see this signal. A
+		// HandleCmd call that is blocked is not interrupted by this; spin
+		// only exits once it returns.
+		lc.conn.Close()
+	})
 }
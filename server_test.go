@@ -0,0 +1,326 @@
+package manatcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// lineServerClient is a minimal ServerClient built on the same newline
+// framing as lineClient, echoing back whatever it's handed. Used by the
+// Listener tests below.
+type lineServerClient struct {
+	// handling, if set, is closed once HandleCmd has been called, so tests
+	// can synchronize on a command having started being handled.
+	handling chan struct{}
+
+	// release, if set, is read from by HandleCmd before it returns, so tests
+	// can hold a command "in flight" until they choose to let it go.
+	release chan struct{}
+}
+
+func (c *lineServerClient) Read(r *bufio.Reader) (interface{}, bool) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, true
+	}
+	return bytes.TrimRight(line, "\n"), false
+}
+
+func (c *lineServerClient) Write(w *bufio.Writer, item interface{}) bool {
+	if _, err := w.Write(item.([]byte)); err != nil {
+		return true
+	}
+	return w.WriteByte('\n') != nil
+}
+
+func (c *lineServerClient) HandleCmd(item interface{}) (interface{}, bool, bool) {
+	if c.handling != nil {
+		close(c.handling)
+	}
+	if c.release != nil {
+		<-c.release
+	}
+	return item, true, false
+}
+
+func (c *lineServerClient) Closing() {}
+
+// Ping implements Pinger unconditionally; it's only ever consulted by a
+// Listener whose Ping.Interval is non-zero, so this has no effect on tests
+// that don't set one.
+func (c *lineServerClient) Ping() interface{} { return []byte("PING") }
+
+// lineServer builds a lineServerClient for every connection via newClient,
+// so tests can configure (or observe) each connection's ServerClient.
+type lineServer struct {
+	newClient func(*ListenerConn) *lineServerClient
+}
+
+func (s lineServer) Connected(lc *ListenerConn) (ServerClient, bool) {
+	return s.newClient(lc), false
+}
+
+// TestListenerShutdownWaitsForInFlightHandleCmd guards the graceful-drain
+// half of Shutdown's contract: it must not return until a HandleCmd call
+// already in progress finishes and its response reaches the client, rather
+// than cutting the connection out from under it.
+func TestListenerShutdownWaitsForInFlightHandleCmd(t *testing.T) {
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	srv := lineServer{newClient: func(*ListenerConn) *lineServerClient {
+		return &lineServerClient{handling: handling, release: release}
+	}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Serve(srv, ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := Dial(lineClient{}, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range conn.PushCh {
+		}
+	}()
+
+	type result struct {
+		item interface{}
+		err  error
+		die  bool
+	}
+	cmdDone := make(chan result, 1)
+	go func() {
+		item, err, die := conn.Cmd([]byte("hi"))
+		cmdDone <- result{item, err, die}
+	}()
+	<-handling
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		shutdownDone <- l.Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-shutdownDone:
+		t.Fatalf("Shutdown returned (err=%v) while HandleCmd was still in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+
+	if err := <-shutdownDone; err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+
+	res := <-cmdDone
+	if res.err != nil || res.die {
+		t.Fatalf("Cmd returned unexpected error/die: %v/%v", res.err, res.die)
+	}
+	if got := string(res.item.([]byte)); got != "hi" {
+		t.Fatalf("got %q, want %q", got, "hi")
+	}
+}
+
+// TestListenerShutdownForceClosesAfterCtxDeadline checks the other half of
+// Shutdown's contract: if a connection hasn't finished draining by the time
+// ctx is done, Shutdown force-closes it and returns ctx.Err() rather than
+// waiting forever. The connection is stalled by pushing more data than the
+// client (which never reads anything) has buffer for, so lc.write blocks
+// writing it out the way a genuinely stalled client would stall it, not by blocking
+// inside HandleCmd itself (which Shutdown makes no promise to interrupt).
+func TestListenerShutdownForceClosesAfterCtxDeadline(t *testing.T) {
+	srv := lineServer{newClient: func(lc *ListenerConn) *lineServerClient {
+		go func() {
+			big := bytes.Repeat([]byte("x"), 64<<20)
+			select {
+			case lc.PushCh <- big:
+			case <-lc.CloseCh:
+			}
+		}()
+		return &lineServerClient{}
+	}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Serve(srv, ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A raw, never-read-from net.Conn stands in for a stalled client: once
+	// the server's 64MiB push exceeds the socket's send buffer, lc.write
+	// blocks writing it (bufio hands a write that large straight to the
+	// conn) until something closes the connection out from under it.
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	// Give the push time to start and fill the send buffer.
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = l.Shutdown(ctx)
+	if err != ctx.Err() {
+		t.Fatalf("got err %v, want %v", err, ctx.Err())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Shutdown took %v to force-close a connection stuck past a 50ms deadline", elapsed)
+	}
+}
+
+// TestListenerPingReapsIdleConnection checks that a connection which never
+// acks the idle-ping heartbeat gets force-closed once PingOpts.Timeout
+// elapses. The Listener is built directly (rather than via Serve) so
+// PingOpts can be set before spin starts accepting, per its doc-comment.
+func TestListenerPingReapsIdleConnection(t *testing.T) {
+	connCh := make(chan *ListenerConn, 1)
+	srv := lineServer{newClient: func(lc *ListenerConn) *lineServerClient {
+		connCh <- lc
+		return &lineServerClient{}
+	}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &Listener{
+		listen:   ln,
+		server:   srv,
+		ErrCh:    make(chan error),
+		conns:    map[*ListenerConn]struct{}{},
+		closedCh: make(chan struct{}),
+		Ping:     PingOpts{Interval: 10 * time.Millisecond, Timeout: 10 * time.Millisecond},
+	}
+	go l.spin()
+	defer l.Close()
+
+	// lineClient never replies to anything it reads (it only ever responds
+	// to its own Cmd calls, which this test never makes), so from the
+	// server's perspective this connection sits idle forever on its own.
+	conn, err := Dial(lineClient{}, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		for range conn.PushCh {
+		}
+	}()
+
+	var lc *ListenerConn
+	select {
+	case lc = <-connCh:
+	case <-time.After(time.Second):
+		t.Fatal("server never observed the connection")
+	}
+
+	select {
+	case <-lc.CloseCh:
+	case <-time.After(time.Second):
+		t.Fatal("idle connection was not reaped within the ping timeout")
+	}
+}
+
+// TestServeRoundTrip checks Serve's entry point directly: a Server handed an
+// already-constructed net.Listener accepts connections and handles commands
+// the same as one built through Listen.
+func TestServeRoundTrip(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := lineServer{newClient: func(*ListenerConn) *lineServerClient {
+		return &lineServerClient{}
+	}}
+	l, err := Serve(srv, ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := Dial(lineClient{}, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		for range conn.PushCh {
+		}
+	}()
+
+	got, err, die := conn.Cmd([]byte("hi"))
+	if err != nil || die {
+		t.Fatalf("unexpected error/die: %v/%v", err, die)
+	}
+	if s := string(got.([]byte)); s != "hi" {
+		t.Fatalf("got %q, want %q", s, "hi")
+	}
+}
+
+// TestListenWithOptsTLSAndKeepAlive checks that ListenWithOpts actually
+// applies TLSConfig (a client that doesn't trust the cert can't complete a
+// round trip; one that does, can) and that setting KeepAlive alongside it
+// doesn't break accepting connections through the resulting listener. A
+// Unix socket is used so the listener's address is known ahead of dialing;
+// KeepAlive has no effect on it (keepAliveListener only acts on
+// *net.TCPConn), so this only exercises that its wrapping doesn't interfere
+// with a TLS listener layered on top of it.
+func TestListenWithOptsTLSAndKeepAlive(t *testing.T) {
+	cert := genSelfSignedCert(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	sockPath := filepath.Join(t.TempDir(), "manatcp-test.sock")
+	srv := lineServer{newClient: func(*ListenerConn) *lineServerClient {
+		return &lineServerClient{}
+	}}
+	l, err := ListenWithOpts(srv, "unix", sockPath, ListenOpts{
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		KeepAlive: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := DialWithOpts(lineClient{}, "unix", sockPath, DialOpts{
+		TLSConfig: &tls.Config{ServerName: "manatcp-test", RootCAs: pool},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		for range conn.PushCh {
+		}
+	}()
+
+	got, err, die := conn.Cmd([]byte("hi"))
+	if err != nil || die {
+		t.Fatalf("unexpected error/die: %v/%v", err, die)
+	}
+	if s := string(got.([]byte)); s != "hi" {
+		t.Fatalf("got %q, want %q", s, "hi")
+	}
+}